@@ -0,0 +1,243 @@
+package pprof
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// ProfileKind identifies which cumulative pprof profile a
+// DeltaProfileBuilder is tracking. Different kinds have different
+// sample-value layouts, and only some value indices are cumulative
+// counters (delta'd across snapshots) versus point-in-time gauges
+// (left absolute), so the builder needs to know which kind it's
+// dealing with.
+type ProfileKind int
+
+const (
+	ProfileKindHeap ProfileKind = iota
+	ProfileKindBlock
+	ProfileKindMutex
+)
+
+type sampleType struct{ typ, unit string }
+
+// layout returns kind's sample-type vector alongside a parallel slice
+// telling us, per value index, whether that dimension is a cumulative
+// counter (true, so it gets delta'd) or an absolute gauge (false, so
+// it's passed through unchanged).
+func (k ProfileKind) layout() (types []sampleType, cumulative []bool) {
+	switch k {
+	case ProfileKindHeap:
+		return []sampleType{
+				{"alloc_objects", "count"},
+				{"alloc_space", "bytes"},
+				{"inuse_objects", "count"},
+				{"inuse_space", "bytes"},
+			},
+			[]bool{true, true, false, false}
+	case ProfileKindBlock, ProfileKindMutex:
+		return []sampleType{
+				{"contentions", "count"},
+				{"delay", "nanoseconds"},
+			},
+			[]bool{true, true}
+	default:
+		return nil, nil
+	}
+}
+
+// periodType returns kind's PeriodType value, matching the convention
+// runtime/pprof uses: heap periods are measured in average sampled
+// bytes, block/mutex periods in contended events.
+func (k ProfileKind) periodType() sampleType {
+	switch k {
+	case ProfileKindHeap:
+		return sampleType{"space", "bytes"}
+	case ProfileKindBlock, ProfileKindMutex:
+		return sampleType{"contentions", "count"}
+	default:
+		return sampleType{}
+	}
+}
+
+// DeltaSample is one stack + value vector fed into a
+// DeltaProfileBuilder. It's kept independent of any particular
+// runtime.*ProfileRecord type so heap, block, and mutex snapshots can
+// all be accumulated through the same API.
+type DeltaSample struct {
+	Stack  []uint64
+	Values []int64
+	Labels map[string][]string
+}
+
+// deltaState is what a DeltaProfileBuilder remembers about one stack
+// between calls to Write.
+type deltaState struct {
+	stack  []uint64
+	labels map[string][]string
+	values []int64
+}
+
+// DeltaProfileBuilder maintains state between successive snapshots of
+// a cumulative profile (heap, block, mutex) and, on each Write, emits
+// only the per-sample difference since the previous snapshot. This
+// lets a caller scrape e.g. /debug/pprof/heap on an interval and ship
+// a small profile each time instead of an ever-growing cumulative one.
+type DeltaProfileBuilder struct {
+	kind ProfileKind
+	rate int64
+	prev map[string]*deltaState
+}
+
+// NewDeltaProfileBuilder returns a DeltaProfileBuilder tracking kind.
+// rate is the sampling rate in effect for kind (MemProfileRate for
+// heap, the block/mutex profile fraction for block and mutex) and is
+// emitted as every output profile's Period, the same way
+// WriteHeapProto does for a non-delta heap profile.
+func NewDeltaProfileBuilder(kind ProfileKind, rate int64) *DeltaProfileBuilder {
+	return &DeltaProfileBuilder{
+		kind: kind,
+		rate: rate,
+		prev: map[string]*deltaState{},
+	}
+}
+
+// Write encodes, to w, the difference between samples and whatever
+// DeltaProfileBuilder last saw for each stack (the samples themselves,
+// on the first call), symbolizing stacks with locMap. Samples whose
+// delta is entirely zero are dropped.
+func (d *DeltaProfileBuilder) Write(w io.Writer, locMap LocMap, samples []DeltaSample) error {
+	types, cumulative := d.kind.layout()
+	if types == nil {
+		return fmt.Errorf("pprof: DeltaProfileBuilder: unsupported profile kind %d", d.kind)
+	}
+
+	b := newProfileBuilder(w, locMap)
+	for _, st := range types {
+		b.pbValueType(tagProfile_SampleType, st.typ, st.unit)
+	}
+	pt := d.kind.periodType()
+	b.pbValueType(tagProfile_PeriodType, pt.typ, pt.unit)
+	b.pb.int64Opt(tagProfile_Period, d.rate)
+
+	seen := make(map[string]bool, len(samples))
+	var locs []uint64
+	for _, s := range samples {
+		key := deltaKey(s.Stack, s.Labels, nil)
+		seen[key] = true
+
+		delta := diffValues(s.Values, d.prev[key], cumulative)
+		d.prev[key] = &deltaState{stack: s.Stack, labels: s.Labels, values: append([]int64(nil), s.Values...)}
+
+		if allZero(delta) {
+			continue
+		}
+		locs = b.appendLocsForStack(locs[:0], s.Stack)
+		b.pbSample(delta, locs, labelWriter(b, s.Labels))
+	}
+
+	// A stack that disappeared between snapshots (Go's heap profile is
+	// monotone in its set of call sites, so in practice this rarely
+	// fires) still owes a final "cleared" delta of 0-prev; the state
+	// is kept, not deleted, with its baseline reset to zero so the
+	// site starts fresh if it reappears rather than double-counting.
+	for key, st := range d.prev {
+		if seen[key] {
+			continue
+		}
+		delta := diffValues(make([]int64, len(st.values)), st, cumulative)
+		if !allZero(delta) {
+			locs = b.appendLocsForStack(locs[:0], st.stack)
+			b.pbSample(delta, locs, labelWriter(b, st.labels))
+		}
+		st.values = make([]int64, len(st.values))
+	}
+
+	b.finish()
+	return nil
+}
+
+// diffValues returns values with each cumulative dimension replaced by
+// its difference from prev (0 if prev is nil, i.e. this is the first
+// time the stack has been seen). Absolute dimensions pass through
+// unchanged.
+func diffValues(values []int64, prev *deltaState, cumulative []bool) []int64 {
+	out := append([]int64(nil), values...)
+	if prev == nil {
+		return out
+	}
+	for i, isCumulative := range cumulative {
+		if isCumulative && i < len(prev.values) && i < len(out) {
+			out[i] -= prev.values[i]
+		}
+	}
+	return out
+}
+
+func allZero(values []int64) bool {
+	for _, v := range values {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// labelWriter returns the pbSample labels callback for the given
+// label set, in a stable (sorted) key order so encoding the same
+// sample twice produces byte-identical output.
+func labelWriter(b *ProfileBuilder, labels map[string][]string) func() {
+	if len(labels) == 0 {
+		return nil
+	}
+	return func() {
+		for _, k := range sortedStringKeys(labels) {
+			for _, v := range labels[k] {
+				b.pbLabel(tagSample_Label, k, v, 0)
+			}
+		}
+	}
+}
+
+// deltaKey hashes a stack and its string and numeric label sets into a
+// stable string key so DeltaProfileBuilder and Merger can recognize
+// the "same" sample across snapshots/inputs regardless of map
+// iteration order. numLabels may be nil; callers with no numeric
+// labels of their own (DeltaSample has none) just pass nil.
+func deltaKey(stack []uint64, labels map[string][]string, numLabels map[string]int64) string {
+	h := fnv.New64a()
+	for _, pc := range stack {
+		var buf [8]byte
+		for i := range buf {
+			buf[i] = byte(pc >> (8 * i))
+		}
+		h.Write(buf[:])
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte(k))
+		vs := append([]string(nil), labels[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			h.Write([]byte(v))
+		}
+	}
+
+	numKeys := make([]string, 0, len(numLabels))
+	for k := range numLabels {
+		numKeys = append(numKeys, k)
+	}
+	sort.Strings(numKeys)
+	for _, k := range numKeys {
+		h.Write([]byte(k))
+		fmt.Fprintf(h, "%d", numLabels[k])
+	}
+	return fmt.Sprintf("%x", h.Sum64())
+}
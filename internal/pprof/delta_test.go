@@ -0,0 +1,153 @@
+package pprof
+
+import (
+	"bytes"
+	"testing"
+)
+
+var deltaTestLocMap = LocMap{
+	1: {{Function: "pkg.F", File: "f.go", Line: 1, Entry: 1}},
+	2: {{Function: "pkg.G", File: "g.go", Line: 2, Entry: 2}},
+}
+
+// writeDelta runs one DeltaProfileBuilder.Write and decodes the result,
+// letting tests assert on the emitted samples without hand-rolling
+// protobuf.
+func writeDelta(t *testing.T, d *DeltaProfileBuilder, samples []DeltaSample) *decodedProfile {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := d.Write(&buf, deltaTestLocMap, samples); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	p, err := decodeProfile(&buf)
+	if err != nil {
+		t.Fatalf("decodeProfile: %v", err)
+	}
+	return p
+}
+
+// sampleFunc returns the innermost frame's Function name for s, so
+// tests can identify which DeltaSample a decoded sample came from.
+func sampleFunc(p *decodedProfile, s decodedSample) string {
+	if len(s.locationIDs) == 0 {
+		return ""
+	}
+	frames := p.locations[s.locationIDs[0]]
+	if len(frames) == 0 {
+		return ""
+	}
+	return frames[0].Function
+}
+
+func TestDeltaProfileBuilderFirstSnapshotIsAbsolute(t *testing.T) {
+	d := NewDeltaProfileBuilder(ProfileKindHeap, 512*1024)
+	p := writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{10, 100, 5, 50}},
+	})
+
+	if p.periodType.typ != "space" || p.periodType.unit != "bytes" {
+		t.Errorf("periodType: got %+v, want {space bytes}", p.periodType)
+	}
+	if p.period != 512*1024 {
+		t.Errorf("period: got %d, want %d", p.period, 512*1024)
+	}
+	if len(p.samples) != 1 {
+		t.Fatalf("samples: got %d, want 1", len(p.samples))
+	}
+	if got, want := p.samples[0].values, []int64{10, 100, 5, 50}; !int64sEqual(got, want) {
+		t.Errorf("first snapshot values: got %v, want %v", got, want)
+	}
+}
+
+func TestDeltaProfileBuilderSubtractsCumulativeDimensions(t *testing.T) {
+	d := NewDeltaProfileBuilder(ProfileKindHeap, 512*1024)
+	writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{10, 100, 5, 50}},
+	})
+	p := writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{15, 150, 8, 80}},
+	})
+
+	if len(p.samples) != 1 {
+		t.Fatalf("samples: got %d, want 1", len(p.samples))
+	}
+	// alloc_objects/alloc_space are cumulative, so they delta (15-10,
+	// 150-100); inuse_objects/inuse_space are gauges, so they pass
+	// through as the latest absolute value (8, 80).
+	if got, want := p.samples[0].values, []int64{5, 50, 8, 80}; !int64sEqual(got, want) {
+		t.Errorf("second snapshot values: got %v, want %v", got, want)
+	}
+}
+
+func TestDeltaProfileBuilderDropsAllZeroDelta(t *testing.T) {
+	d := NewDeltaProfileBuilder(ProfileKindHeap, 512*1024)
+	writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{10, 100, 0, 0}},
+	})
+	p := writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{10, 100, 0, 0}},
+	})
+	if len(p.samples) != 0 {
+		t.Errorf("samples: got %d, want 0 (unchanged stack should be dropped)", len(p.samples))
+	}
+}
+
+func TestDeltaProfileBuilderClearedStackEmitsFinalZeroingDelta(t *testing.T) {
+	d := NewDeltaProfileBuilder(ProfileKindHeap, 512*1024)
+	writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{10, 100, 5, 50}},
+	})
+
+	// pkg.F's stack is gone from this snapshot; pkg.G is new.
+	p := writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{2}, Values: []int64{1, 10, 1, 10}},
+	})
+
+	if len(p.samples) != 2 {
+		t.Fatalf("samples: got %d, want 2 (new stack + cleared stack's final delta)", len(p.samples))
+	}
+	var gotF, gotG bool
+	for _, s := range p.samples {
+		switch sampleFunc(p, s) {
+		case "pkg.F":
+			gotF = true
+			if got, want := s.values, []int64{-10, -100, 0, 0}; !int64sEqual(got, want) {
+				t.Errorf("cleared stack's final delta: got %v, want %v", got, want)
+			}
+		case "pkg.G":
+			gotG = true
+			if got, want := s.values, []int64{1, 10, 1, 10}; !int64sEqual(got, want) {
+				t.Errorf("new stack's first delta: got %v, want %v", got, want)
+			}
+		}
+	}
+	if !gotF || !gotG {
+		t.Fatalf("expected samples for both pkg.F and pkg.G, got %+v", p.samples)
+	}
+
+	// The cleared stack's baseline was reset to zero, so if it
+	// reappears its next delta starts fresh instead of double-counting
+	// against the pre-clear values.
+	p = writeDelta(t, d, []DeltaSample{
+		{Stack: []uint64{1}, Values: []int64{3, 30, 2, 20}},
+	})
+	for _, s := range p.samples {
+		if sampleFunc(p, s) == "pkg.F" {
+			if got, want := s.values, []int64{3, 30, 2, 20}; !int64sEqual(got, want) {
+				t.Errorf("reappeared stack's delta: got %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func int64sEqual(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
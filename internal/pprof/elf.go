@@ -0,0 +1,83 @@
+package pprof
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+)
+
+var errNoBuildIDNote = errors.New("pprof: no build ID note found")
+
+// elfBuildID returns the build ID embedded in the ELF binary at path.
+// It looks at .note.gnu.build-id first, matching what the GNU linker
+// and most distro toolchains produce, and falls back to
+// .note.go.buildid for binaries linked by the Go toolchain without a
+// GNU note.
+func elfBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if id, err := elfNoteBuildID(f, ".note.gnu.build-id", true); err == nil {
+		return id, nil
+	}
+	return elfNoteBuildID(f, ".note.go.buildid", false)
+}
+
+// elfNoteBuildID reads section's note descriptor and returns the build
+// ID it holds. hexEncode selects how the descriptor encodes it:
+// .note.gnu.build-id's descriptor is opaque binary, hex-encoded the
+// way every GNU/pprof-adjacent tool expects; .note.go.buildid's
+// descriptor is the literal build-ID string the Go linker wrote there
+// (cmd/link/internal/ld/elf.go's addgonote), which must be returned
+// as-is rather than hex-encoded, or it won't match what any consumer
+// (e.g. a symbol server matching by build ID) expects.
+func elfNoteBuildID(f *elf.File, section string, hexEncode bool) (string, error) {
+	sec := f.Section(section)
+	if sec == nil {
+		return "", errNoBuildIDNote
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return "", err
+	}
+	desc, err := parseNoteDescriptor(f.ByteOrder, data)
+	if err != nil {
+		return "", err
+	}
+	if hexEncode {
+		return hex.EncodeToString(desc), nil
+	}
+	return string(desc), nil
+}
+
+// parseNoteDescriptor decodes a single ELF note — a 4-byte-aligned
+// (namesz, descsz, type) header followed by the name and descriptor —
+// and returns the descriptor bytes, which is where both GNU and Go
+// build IDs live.
+func parseNoteDescriptor(order elfByteOrder, note []byte) ([]byte, error) {
+	const headerSize = 12 // namesz, descsz, type: uint32 each
+	if len(note) < headerSize {
+		return nil, errNoBuildIDNote
+	}
+	namesz := order.Uint32(note[0:4])
+	descsz := order.Uint32(note[4:8])
+
+	descOff := headerSize + align4(int(namesz))
+	descEnd := descOff + int(descsz)
+	if descOff < headerSize || descEnd > len(note) {
+		return nil, errNoBuildIDNote
+	}
+	return note[descOff:descEnd], nil
+}
+
+func align4(n int) int { return (n + 3) &^ 3 }
+
+// elfByteOrder is the subset of binary.ByteOrder that elf.File.ByteOrder
+// satisfies; named here so parseNoteDescriptor doesn't need to import
+// encoding/binary just for the parameter type.
+type elfByteOrder interface {
+	Uint32([]byte) uint32
+}
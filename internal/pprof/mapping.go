@@ -0,0 +1,97 @@
+package pprof
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readMapping reads /proc/self/maps and writes mappings to b.pb.
+// It saves the address ranges of the mappings in b.mem for use
+// when emitting locations. On platforms where /proc/self/maps isn't
+// available (anything but Linux, or a Linux process without procfs
+// mounted), it falls back to a single fake, unsymbolized mapping so
+// that locations still have somewhere to point.
+//
+// There is currently no Darwin or Windows equivalent wired up here;
+// until one enumerates loaded modules on those platforms, readBuildID
+// only ever tries the ELF path.
+func (b *ProfileBuilder) readMapping() {
+	f, err := os.Open("/proc/self/maps")
+	if err != nil {
+		b.addMappingEntry(0, 0, 0, "", "", true)
+		// TODO(hyangah): make addMapping return *memMap or
+		// take a memMap struct, and get rid of addMappingEntry
+		// that takes a bunch of positional arguments.
+		return
+	}
+	defer f.Close()
+	parseProcSelfMaps(f, b.addMapping)
+}
+
+// parseProcSelfMaps parses the /proc/self/maps format read from r,
+// calling add once per file-backed executable segment with the
+// build ID extracted from that segment's backing file, if any could
+// be found. It's split out from readMapping so platforms without
+// /proc/self/maps (or tests) can feed it an equivalent mapping source.
+func parseProcSelfMaps(r io.Reader, add func(lo, hi, offset uint64, file, buildID string)) {
+	buildIDs := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Typical line:
+		// 00400000-00452000 r-xp 00000000 08:02 173521 /usr/bin/foo
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			continue
+		}
+		lo, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			continue
+		}
+		hi, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		offset, err := strconv.ParseUint(fields[2], 16, 64)
+		if err != nil {
+			continue
+		}
+		perms := fields[1]
+		if !strings.Contains(perms, "x") {
+			// Non-executable mappings (heap, stack, data segments)
+			// never hold code worth symbolizing.
+			continue
+		}
+		var file string
+		if len(fields) >= 6 {
+			file = fields[5]
+		}
+		if file == "" || strings.HasPrefix(file, "[") {
+			// Anonymous or pseudo mappings such as [vdso], [stack].
+			continue
+		}
+
+		buildID, cached := buildIDs[file]
+		if !cached {
+			buildID, _ = readBuildID(file)
+			buildIDs[file] = buildID
+		}
+		add(lo, hi, offset, file, buildID)
+	}
+}
+
+// readBuildID extracts the build ID embedded in the executable or
+// shared object at path by reading its ELF build-ID note. There is no
+// caller that can reach a non-ELF binary yet (parseProcSelfMaps only
+// ever runs against Linux's /proc/self/maps), so a PE/Windows path
+// isn't implemented here.
+func readBuildID(path string) (string, error) {
+	return elfBuildID(path)
+}
@@ -0,0 +1,108 @@
+package pprof
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseProcSelfMaps(t *testing.T) {
+	const maps = `00400000-00452000 r-xp 00000000 08:02 173521                     /usr/bin/foo
+00651000-00652000 rw-p 00051000 08:02 173521                     /usr/bin/foo
+7f1234500000-7f1234521000 r--p 00000000 00:00 0                  [vdso]
+7f1234600000-7f1234700000 r-xp 00000000 08:02 298212             /lib/x86_64-linux-gnu/libc.so.6
+7ffee0000000-7ffee0021000 rw-p 00000000 00:00 0                  [stack]
+`
+	type got struct {
+		lo, hi, offset uint64
+		file           string
+	}
+	var entries []got
+	parseProcSelfMaps(strings.NewReader(maps), func(lo, hi, offset uint64, file, buildID string) {
+		entries = append(entries, got{lo, hi, offset, file})
+	})
+
+	want := []got{
+		{0x00400000, 0x00452000, 0, "/usr/bin/foo"},
+		{0x7f1234600000, 0x7f1234700000, 0, "/lib/x86_64-linux-gnu/libc.so.6"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("parseProcSelfMaps: got %d entries %+v, want %d", len(entries), entries, len(want))
+	}
+	for i, w := range want {
+		if entries[i] != w {
+			t.Errorf("entry %d: got %+v, want %+v", i, entries[i], w)
+		}
+	}
+}
+
+func TestParseProcSelfMapsSkipsNonExecutable(t *testing.T) {
+	const maps = `00600000-00601000 rw-p 00000000 08:02 173521                     /usr/bin/foo
+`
+	var called bool
+	parseProcSelfMaps(strings.NewReader(maps), func(lo, hi, offset uint64, file, buildID string) {
+		called = true
+	})
+	if called {
+		t.Fatal("parseProcSelfMaps called add for a non-executable mapping")
+	}
+}
+
+func TestParseNoteDescriptor(t *testing.T) {
+	// A minimal ELF note: namesz=4 ("GNU\x00"), descsz=4 (the build ID
+	// bytes), type=3 (NT_GNU_BUILD_ID), each header field 4-byte
+	// aligned per the ELF note format.
+	note := []byte{
+		4, 0, 0, 0, // namesz
+		4, 0, 0, 0, // descsz
+		3, 0, 0, 0, // type
+		'G', 'N', 'U', 0, // name, already 4-byte aligned
+		0xde, 0xad, 0xbe, 0xef, // desc (the build ID)
+	}
+
+	desc, err := parseNoteDescriptor(littleEndian{}, note)
+	if err != nil {
+		t.Fatalf("parseNoteDescriptor: %v", err)
+	}
+	if want := "deadbeef"; hex.EncodeToString(desc) != want {
+		t.Errorf("parseNoteDescriptor: got %x, want %s", desc, want)
+	}
+}
+
+func TestParseNoteDescriptorTruncated(t *testing.T) {
+	note := []byte{4, 0, 0, 0, 4, 0, 0, 0, 3, 0, 0, 0, 'G', 'N', 'U', 0}
+	if _, err := parseNoteDescriptor(littleEndian{}, note); err == nil {
+		t.Fatal("parseNoteDescriptor: want error for a note whose descriptor is truncated")
+	}
+}
+
+// TestParseNoteDescriptorGoBuildID verifies that a .note.go.buildid
+// descriptor — the literal build-ID string the Go linker writes, not
+// opaque binary like the GNU note's — decodes back to that same
+// string when taken as-is, not hex-encoded.
+func TestParseNoteDescriptorGoBuildID(t *testing.T) {
+	const buildID = "rstFsE3b9P4dk7OGDwy0/2V1rX_hf8qLjT6wNpZmMc"
+	note := []byte{
+		4, 0, 0, 0, // namesz
+		byte(len(buildID)), 0, 0, 0, // descsz
+		4, 0, 0, 0, // type (ELF_NOTE_GOBUILDID_TAG)
+		'G', 'o', 0, 0, // name, already 4-byte aligned
+	}
+	note = append(note, buildID...)
+
+	desc, err := parseNoteDescriptor(littleEndian{}, note)
+	if err != nil {
+		t.Fatalf("parseNoteDescriptor: %v", err)
+	}
+	if got := string(desc); got != buildID {
+		t.Errorf("parseNoteDescriptor: got %q, want %q", got, buildID)
+	}
+}
+
+// littleEndian is a minimal elfByteOrder for tests, avoiding a
+// dependency on a real ELF file just to exercise parseNoteDescriptor.
+type littleEndian struct{}
+
+func (littleEndian) Uint32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
@@ -0,0 +1,533 @@
+package pprof
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Merger accumulates one or more already-encoded pprof.proto profiles
+// and, via Write, emits their sum as a single profile through the
+// same ProfileBuilder used to produce each per-agent upload. This
+// lets profefe combine per-minute agent uploads into hourly/daily
+// rollups server-side without depending on the full
+// github.com/google/pprof/profile package.
+type Merger struct {
+	sampleTypes   []sampleType
+	periodType    sampleType
+	havePeriod    bool
+	period        int64
+	timeNanos     int64 // earliest TimeNanos seen across inputs
+	durationNanos int64 // summed across inputs
+
+	locKeyToAddr map[string]uint64
+	nextAddr     uint64
+	locMap       LocMap
+
+	sums  map[string]*mergedSample
+	order []string // first-seen order, for deterministic output
+}
+
+type mergedSample struct {
+	stack     []uint64
+	values    []int64
+	labels    map[string][]string
+	numLabels map[string]int64
+}
+
+// NewMerger returns an empty Merger. Feed it profiles with Add, then
+// call Write once to emit the combined result.
+func NewMerger() *Merger {
+	return &Merger{
+		locKeyToAddr: map[string]uint64{},
+		locMap:       LocMap{},
+		sums:         map[string]*mergedSample{},
+	}
+}
+
+// Add decodes one pprof.proto stream from r and folds its samples into
+// the merge in progress. Every profile added must carry the same
+// sample-type vector (same types and units, in the same order) and the
+// same PeriodType/Period as the first one added.
+func (m *Merger) Add(r io.Reader) error {
+	p, err := decodeProfile(r)
+	if err != nil {
+		return fmt.Errorf("pprof: Merger.Add: %w", err)
+	}
+
+	if m.sampleTypes == nil {
+		m.sampleTypes = p.sampleTypes
+		m.periodType = p.periodType
+		m.havePeriod = p.havePeriod
+		m.period = p.period
+		m.timeNanos = p.timeNanos
+	} else {
+		if !sampleTypesEqual(m.sampleTypes, p.sampleTypes) {
+			return fmt.Errorf("pprof: Merger.Add: incompatible sample types %v vs %v", m.sampleTypes, p.sampleTypes)
+		}
+		if m.havePeriod != p.havePeriod || m.periodType != p.periodType || m.period != p.period {
+			return fmt.Errorf("pprof: Merger.Add: incompatible period type/value across profiles")
+		}
+		if p.timeNanos != 0 && (m.timeNanos == 0 || p.timeNanos < m.timeNanos) {
+			m.timeNanos = p.timeNanos
+		}
+	}
+	m.durationNanos += p.durationNanos
+
+	for _, s := range p.samples {
+		stack := make([]uint64, 0, len(s.locationIDs))
+		for _, locID := range s.locationIDs {
+			stack = append(stack, m.addrFor(p.locations[locID]))
+		}
+
+		key := deltaKey(stack, s.labels, s.numLabels)
+		if existing, ok := m.sums[key]; ok {
+			for i, v := range s.values {
+				if i < len(existing.values) {
+					existing.values[i] += v
+				}
+			}
+			continue
+		}
+		m.sums[key] = &mergedSample{stack: stack, values: append([]int64(nil), s.values...), labels: s.labels, numLabels: s.numLabels}
+		m.order = append(m.order, key)
+	}
+	return nil
+}
+
+// addrFor returns a synthetic, stable "address" for frames, minting a
+// new one the first time this exact call chain is seen. Since every
+// distinct chain maps to exactly one address, identical stacks from
+// different input profiles collapse onto the same output Location no
+// matter what location ID they used in their own profile.
+func (m *Merger) addrFor(frames []Frame) uint64 {
+	key := locationKey(frames)
+	if addr, ok := m.locKeyToAddr[key]; ok {
+		return addr
+	}
+	m.nextAddr++
+	m.locKeyToAddr[key] = m.nextAddr
+	m.locMap[m.nextAddr] = frames
+	return m.nextAddr
+}
+
+func locationKey(frames []Frame) string {
+	var b strings.Builder
+	for _, f := range frames {
+		b.WriteString(f.Function)
+		b.WriteByte(0)
+		b.WriteString(f.File)
+		b.WriteByte(0)
+		fmt.Fprintf(&b, "%d", f.Line)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func sampleTypesEqual(a, b []sampleType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Write encodes the merged profile to w and closes it. It's an error
+// to call Write before at least one profile has been Added.
+func (m *Merger) Write(w io.Writer) error {
+	if m.sampleTypes == nil {
+		return errors.New("pprof: Merger.Write: no profiles added")
+	}
+
+	// Merged samples live at synthetic addresses minted by addrFor, not
+	// real addresses in this process, so reading this process's own
+	// /proc/self/maps (what newProfileBuilder does) would be both
+	// wasted I/O and meaningless. decodeProfile doesn't track which
+	// input Mapping a given Location belonged to (Frame carries no
+	// mapping reference), so there's no per-stack mapping to carry
+	// forward here; install the same fake, unsymbolized placeholder
+	// mapping readMapping itself falls back to when no real mapping is
+	// available, so merged Locations still have somewhere to point.
+	b := newProfileBuilderNoMapping(w, m.locMap)
+	b.addMappingEntry(0, 0, 0, "", "", true)
+	b.start = time.Unix(0, m.timeNanos)
+	b.period = m.period
+
+	b.pb.int64Opt(tagProfile_TimeNanos, m.timeNanos)
+	for _, st := range m.sampleTypes {
+		b.pbValueType(tagProfile_SampleType, st.typ, st.unit)
+	}
+	if m.havePeriod {
+		b.pb.int64Opt(tagProfile_DurationNanos, m.durationNanos)
+		b.pbValueType(tagProfile_PeriodType, m.periodType.typ, m.periodType.unit)
+		b.pb.int64Opt(tagProfile_Period, m.period)
+	}
+
+	var locs []uint64
+	for _, key := range m.order {
+		s := m.sums[key]
+		locs = locs[:0]
+		for _, addr := range s.stack {
+			locs = append(locs, b.locForPC(addr))
+		}
+		b.pbSample(s.values, locs, mergedLabelWriter(b, s.labels, s.numLabels))
+	}
+
+	b.finish()
+	return nil
+}
+
+// decodedProfile is the subset of a decoded pprof.proto Profile
+// message Merger needs: its sample-type/period metadata, its samples,
+// and its Locations already resolved down to Frame chains keyed by
+// Location ID. A sample still refers to its Locations by those IDs;
+// Function IDs and string-table indices are already resolved away.
+type decodedProfile struct {
+	sampleTypes   []sampleType
+	periodType    sampleType
+	havePeriod    bool
+	period        int64
+	timeNanos     int64
+	durationNanos int64
+
+	locations map[uint64][]Frame
+	samples   []decodedSample
+}
+
+type decodedFunction struct {
+	name, filename string
+}
+
+type decodedSample struct {
+	locationIDs []uint64
+	values      []int64
+	labels      map[string][]string
+	numLabels   map[string]int64
+}
+
+// mergedLabelWriter returns the pbSample labels callback for a merged
+// sample's string and numeric label sets, in the same stable (sorted)
+// key order AddSample uses, so encoding the same sample twice produces
+// byte-identical output.
+func mergedLabelWriter(b *ProfileBuilder, labels map[string][]string, numLabels map[string]int64) func() {
+	if len(labels) == 0 && len(numLabels) == 0 {
+		return nil
+	}
+	return func() {
+		for _, k := range sortedStringKeys(labels) {
+			for _, v := range labels[k] {
+				b.pbLabel(tagSample_Label, k, v, 0)
+			}
+		}
+		for _, k := range sortedInt64Keys(numLabels) {
+			b.pbLabel(tagSample_Label, k, "", numLabels[k])
+		}
+	}
+}
+
+// decodeProfile gunzips and decodes one pprof.proto stream from r.
+func decodeProfile(r io.Reader) (*decodedProfile, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("gunzip: %w", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var (
+		strTable      []string
+		sampleTypeRaw [][]byte
+		mappingRaw    [][]byte
+		locationRaw   [][]byte
+		functionRaw   [][]byte
+		sampleRaw     [][]byte
+		periodTypeRaw []byte
+
+		timeNanos, durationNanos, period int64
+	)
+	err = decodeFields(data, func(f protoField) error {
+		switch f.tag {
+		case tagProfile_SampleType:
+			sampleTypeRaw = append(sampleTypeRaw, f.buf)
+		case tagProfile_Sample:
+			sampleRaw = append(sampleRaw, f.buf)
+		case tagProfile_Mapping:
+			mappingRaw = append(mappingRaw, f.buf)
+		case tagProfile_Location:
+			locationRaw = append(locationRaw, f.buf)
+		case tagProfile_Function:
+			functionRaw = append(functionRaw, f.buf)
+		case tagProfile_StringTable:
+			strTable = append(strTable, string(f.buf))
+		case tagProfile_TimeNanos:
+			timeNanos = int64(f.u64)
+		case tagProfile_DurationNanos:
+			durationNanos = int64(f.u64)
+		case tagProfile_PeriodType:
+			periodTypeRaw = f.buf
+		case tagProfile_Period:
+			period = int64(f.u64)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode Profile: %w", err)
+	}
+	_ = mappingRaw // mappings aren't needed once locations are resolved to Frames
+
+	p := &decodedProfile{
+		timeNanos:     timeNanos,
+		durationNanos: durationNanos,
+		period:        period,
+		locations:     make(map[uint64][]Frame, len(locationRaw)),
+	}
+
+	for _, buf := range sampleTypeRaw {
+		st, err := decodeValueType(buf, strTable)
+		if err != nil {
+			return nil, fmt.Errorf("decode ValueType: %w", err)
+		}
+		p.sampleTypes = append(p.sampleTypes, st)
+	}
+	if periodTypeRaw != nil {
+		st, err := decodeValueType(periodTypeRaw, strTable)
+		if err != nil {
+			return nil, fmt.Errorf("decode PeriodType: %w", err)
+		}
+		p.periodType = st
+		p.havePeriod = true
+	}
+
+	funcs := make(map[uint64]decodedFunction, len(functionRaw))
+	for _, buf := range functionRaw {
+		id, fn, err := decodeFunction(buf, strTable)
+		if err != nil {
+			return nil, fmt.Errorf("decode Function: %w", err)
+		}
+		funcs[id] = fn
+	}
+
+	for _, buf := range locationRaw {
+		id, frames, err := decodeLocation(buf, funcs)
+		if err != nil {
+			return nil, fmt.Errorf("decode Location: %w", err)
+		}
+		p.locations[id] = frames
+	}
+
+	for _, buf := range sampleRaw {
+		s, err := decodeSample(buf, strTable)
+		if err != nil {
+			return nil, fmt.Errorf("decode Sample: %w", err)
+		}
+		p.samples = append(p.samples, s)
+	}
+
+	return p, nil
+}
+
+func decodeValueType(buf []byte, strTable []string) (sampleType, error) {
+	var st sampleType
+	err := decodeFields(buf, func(f protoField) error {
+		switch f.tag {
+		case tagValueType_Type:
+			st.typ = strAt(strTable, f.u64)
+		case tagValueType_Unit:
+			st.unit = strAt(strTable, f.u64)
+		}
+		return nil
+	})
+	return st, err
+}
+
+func decodeFunction(buf []byte, strTable []string) (id uint64, fn decodedFunction, err error) {
+	err = decodeFields(buf, func(f protoField) error {
+		switch f.tag {
+		case tagFunction_ID:
+			id = f.u64
+		case tagFunction_Name:
+			fn.name = strAt(strTable, f.u64)
+		case tagFunction_Filename:
+			fn.filename = strAt(strTable, f.u64)
+		}
+		return nil
+	})
+	return id, fn, err
+}
+
+func decodeLocation(buf []byte, funcs map[uint64]decodedFunction) (id uint64, frames []Frame, err error) {
+	err = decodeFields(buf, func(f protoField) error {
+		if f.tag != tagLocation_Line {
+			if f.tag == tagLocation_ID {
+				id = f.u64
+			}
+			return nil
+		}
+		var funcID uint64
+		var line int64
+		if err := decodeFields(f.buf, func(lf protoField) error {
+			switch lf.tag {
+			case tagLine_FunctionID:
+				funcID = lf.u64
+			case tagLine_Line:
+				line = int64(lf.u64)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		fn := funcs[funcID]
+		frames = append(frames, Frame{Function: fn.name, File: fn.filename, Line: int(line)})
+		return nil
+	})
+	return id, frames, err
+}
+
+func decodeSample(buf []byte, strTable []string) (decodedSample, error) {
+	var s decodedSample
+	err := decodeFields(buf, func(f protoField) error {
+		switch f.tag {
+		case tagSample_Location:
+			ids, err := decodeUint64s(f)
+			if err != nil {
+				return err
+			}
+			s.locationIDs = append(s.locationIDs, ids...)
+		case tagSample_Value:
+			ids, err := decodeUint64s(f)
+			if err != nil {
+				return err
+			}
+			for _, v := range ids {
+				s.values = append(s.values, int64(v))
+			}
+		case tagSample_Label:
+			var key, str string
+			var num int64
+			var haveNum bool
+			if err := decodeFields(f.buf, func(lf protoField) error {
+				switch lf.tag {
+				case tagLabel_Key:
+					key = strAt(strTable, lf.u64)
+				case tagLabel_Str:
+					str = strAt(strTable, lf.u64)
+				case tagLabel_Num:
+					num = int64(lf.u64)
+					haveNum = true
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if haveNum {
+				if s.numLabels == nil {
+					s.numLabels = map[string]int64{}
+				}
+				s.numLabels[key] = num
+			} else {
+				if s.labels == nil {
+					s.labels = map[string][]string{}
+				}
+				s.labels[key] = append(s.labels[key], str)
+			}
+		}
+		return nil
+	})
+	return s, err
+}
+
+// decodeUint64s returns the values of a repeated uint64/int64 field,
+// accepting either the packed encoding (a single length-delimited
+// field containing concatenated varints, what this package's own
+// writer emits and what protoc emits for [packed=true] fields) or the
+// unpacked one (one varint-wire field per value), so Merger can read
+// profiles produced by other pprof-compatible tools too.
+func decodeUint64s(f protoField) ([]uint64, error) {
+	if f.wire == 0 {
+		return []uint64{f.u64}, nil
+	}
+	var out []uint64
+	buf := f.buf
+	for len(buf) > 0 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errors.New("pprof: malformed packed varint")
+		}
+		out = append(out, v)
+		buf = buf[n:]
+	}
+	return out, nil
+}
+
+func strAt(strTable []string, idx uint64) string {
+	if idx >= uint64(len(strTable)) {
+		return ""
+	}
+	return strTable[idx]
+}
+
+// protoField is one decoded protobuf wire field: its tag, wire type,
+// and payload (the varint value for wire type 0, the raw bytes for
+// wire type 2).
+type protoField struct {
+	tag  int
+	wire int
+	u64  uint64
+	buf  []byte
+}
+
+// decodeFields walks data, the encoded bytes of a single protobuf
+// message, and calls yield once per field found. It understands the
+// two wire types profile.proto uses: varint (0) and length-delimited
+// (2, covering strings, bytes, submessages, and packed repeated
+// scalars).
+func decodeFields(data []byte, yield func(protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("pprof: malformed protobuf tag")
+		}
+		data = data[n:]
+		tag, wire := int(key>>3), int(key&7)
+
+		switch wire {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("pprof: malformed protobuf varint")
+			}
+			data = data[n:]
+			if err := yield(protoField{tag: tag, wire: wire, u64: v}); err != nil {
+				return err
+			}
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("pprof: malformed protobuf length")
+			}
+			data = data[n:]
+			if uint64(len(data)) < l {
+				return errors.New("pprof: truncated protobuf field")
+			}
+			buf := data[:l]
+			data = data[l:]
+			if err := yield(protoField{tag: tag, wire: wire, buf: buf}); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("pprof: unsupported protobuf wire type %d for field %d", wire, tag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package pprof
+
+import "testing"
+
+func TestDecodeFieldsVarintAndLengthDelimited(t *testing.T) {
+	var pb protobuf
+	pb.uint64(1, 42)
+	pb.string(2, "hello")
+	pb.uint64s(3, []uint64{1, 2, 3}) // >2 elements, so packed encoding
+
+	var gotVarint uint64
+	var gotString string
+	var gotPacked []uint64
+	err := decodeFields(pb.data, func(f protoField) error {
+		switch f.tag {
+		case 1:
+			gotVarint = f.u64
+		case 2:
+			gotString = string(f.buf)
+		case 3:
+			vs, err := decodeUint64s(f)
+			if err != nil {
+				return err
+			}
+			gotPacked = vs
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decodeFields: %v", err)
+	}
+	if gotVarint != 42 {
+		t.Errorf("tag 1: got %d, want 42", gotVarint)
+	}
+	if gotString != "hello" {
+		t.Errorf("tag 2: got %q, want %q", gotString, "hello")
+	}
+	if len(gotPacked) != 3 || gotPacked[0] != 1 || gotPacked[1] != 2 || gotPacked[2] != 3 {
+		t.Errorf("tag 3: got %v, want [1 2 3]", gotPacked)
+	}
+}
+
+func TestDecodeFieldsTruncated(t *testing.T) {
+	var pb protobuf
+	pb.string(2, "hello")
+	truncated := pb.data[:len(pb.data)-2]
+
+	err := decodeFields(truncated, func(protoField) error { return nil })
+	if err == nil {
+		t.Fatal("decodeFields: want error for a truncated length-delimited field")
+	}
+}
+
+// TestDecodeSampleKeepsNumericLabelsNumeric verifies a numeric label
+// (written the way AddSample/WriteHeapProto's "bytes" label is, via
+// pbLabel(tag, key, "", num)) decodes into numLabels, not into labels
+// with its value stringified, so Merger.Write can re-emit it through
+// the numeric pbLabel path.
+func TestDecodeSampleKeepsNumericLabelsNumeric(t *testing.T) {
+	var b ProfileBuilder
+	b.strings = []string{""}
+	b.stringMap = map[string]int{"": 0}
+
+	var pb protobuf
+	start := pb.startMessage()
+	pb.uint64Opt(tagLabel_Key, uint64(b.stringIndex("bytes")))
+	pb.int64Opt(tagLabel_Num, 4096)
+	pb.endMessage(tagSample_Label, start)
+
+	s, err := decodeSample(pb.data, b.strings)
+	if err != nil {
+		t.Fatalf("decodeSample: %v", err)
+	}
+	if got, ok := s.numLabels["bytes"]; !ok || got != 4096 {
+		t.Errorf("numLabels[%q] = %d, %v, want 4096, true", "bytes", got, ok)
+	}
+	if _, ok := s.labels["bytes"]; ok {
+		t.Errorf("labels[%q] should be unset for a numeric label, got %v", "bytes", s.labels["bytes"])
+	}
+}
@@ -6,6 +6,22 @@ import (
 	"time"
 )
 
+// Frame describes one user-visible call frame recovered for a PC. A
+// single PC can expand into more than one Frame when the compiler
+// inlined one or more calls into it; in that case LocMap stores them
+// innermost (the PC itself) first, mirroring what
+// runtime.CallersFrames reports for a live PC.
+type Frame struct {
+	Function string // package-qualified function name
+	File     string
+	Line     int
+	Entry    uint64 // entry PC of Function, used to detect a shared inline tower
+}
+
+// LocMap supplies the symbolization data for a PC: the Frame (or
+// chain of inlined Frames) it corresponds to.
+type LocMap map[uint64][]Frame
+
 // A ProfileBuilder writes a profile incrementally from a
 // stream of profile samples delivered by the runtime.
 type ProfileBuilder struct {
@@ -188,6 +204,60 @@ func (b *ProfileBuilder) pbMapping(tag int, id, base, limit, offset uint64, file
 	b.pb.endMessage(tag, start)
 }
 
+// pcDeck accumulates consecutive PCs from one stack that belong to the
+// same inlined call tower. Go's traceback emits one PC per user frame,
+// including synthetic inline marks, so a naive per-PC Location would
+// split one logical call site into several Locations, each carrying a
+// single Line. tryAdd folds those marks back together so they produce
+// one Location with one Line per inlined frame, innermost first,
+// matching pprof's schema.
+type pcDeck struct {
+	pcs    []uint64
+	frames []Frame
+}
+
+func (d *pcDeck) reset() {
+	d.pcs = d.pcs[:0]
+	d.frames = d.frames[:0]
+}
+
+// tryAdd reports whether addr's frames continue the tower already on
+// the deck. frames is addr's own expansion (innermost first, as
+// returned by LocMap / runtime.CallersFrames). The PCs belong to the
+// same tower when addr's innermost frame is the same function, in the
+// same file and with the same entry, as the frame the deck currently
+// ends on; in that case the duplicated boundary frame is dropped and
+// the rest is appended. The Function check matters on top of Entry:
+// two genuinely separate, non-inlined frames of a recursive call share
+// an Entry and File, and without also requiring the Function name to
+// match, tryAdd would merge them and silently drop a level of
+// recursion (maybe recursion, so don't merge).
+func (d *pcDeck) tryAdd(addr uint64, frames []Frame) bool {
+	if len(frames) == 0 {
+		return false
+	}
+	if len(d.frames) > 0 {
+		boundary := d.frames[len(d.frames)-1]
+		innermost := frames[0]
+		if boundary.Entry == 0 || boundary.Entry != innermost.Entry ||
+			boundary.File != innermost.File || boundary.Function != innermost.Function {
+			return false
+		}
+		d.pcs = append(d.pcs, addr)
+		d.frames = append(d.frames, frames[1:]...)
+		return true
+	}
+	d.pcs = append(d.pcs, addr)
+	d.frames = append(d.frames, frames...)
+	return true
+}
+
+// isGoexit reports whether frames is the synthetic runtime.goexit
+// frame that terminates every goroutine's stack.
+func isGoexit(frames []Frame) bool {
+	return len(frames) == 1 && frames[0].Function == "runtime.goexit"
+}
+
 // locForPC returns the location ID for addr.
 // addr must a return PC or 1 + the PC of an inline marker. This returns the location of the corresponding call.
 // It may emit to b.pb, so there must be no message encoding in progress.
@@ -197,6 +267,15 @@ func (b *ProfileBuilder) locForPC(addr uint64) uint64 {
 		return id
 	}
 
+	frames := b.locMap[addr]
+	return b.locForFrames(addr, frames)
+}
+
+// locForFrames writes a single Location for addr made up of frames
+// (innermost first), one Line per frame, and returns its ID. It's
+// split out from locForPC so the stack-walking caller can first grow
+// frames across a run of PCs via pcDeck before a Location is emitted.
+func (b *ProfileBuilder) locForFrames(addr uint64, frames []Frame) uint64 {
 	symbolizeResult := lookupTried
 
 	// We can't write out functions while in the middle of the
@@ -208,13 +287,14 @@ func (b *ProfileBuilder) locForPC(addr uint64) uint64 {
 	}
 	newFuncs := make([]newFunc, 0, 8)
 
-	id = uint64(len(b.locs)) + 1
+	id := uint64(len(b.locs)) + 1
 	b.locs[addr] = int(id)
 	start := b.pb.startMessage()
 	b.pb.uint64Opt(tagLocation_ID, id)
 	b.pb.uint64Opt(tagLocation_Address, uint64(0))
 
-	if frame, ok := b.locMap[addr]; ok {
+	// Lines are emitted innermost first, matching frames' order.
+	for _, frame := range frames {
 		funcID := uint64(b.funcs[frame.Function])
 		if funcID == 0 {
 			funcID = uint64(len(b.funcs)) + 1
@@ -249,13 +329,71 @@ func (b *ProfileBuilder) locForPC(addr uint64) uint64 {
 	return id
 }
 
-// NewProfileBuilder returns a new ProfileBuilder.
-// CPU profiling data obtained from the runtime can be added
-// by calling b.addCPUData, and then the eventual profile
-// can be obtained by calling b.finish.
-func NewProfileBuilder(w io.Writer, locMap LocMap) *ProfileBuilder {
+// appendLocsForStack expands stk (leaf first) into locs, the sequence
+// of Location IDs for a Sample, folding any run of PCs that decomposes
+// a single inline tower into one Location via pcDeck.
+func (b *ProfileBuilder) appendLocsForStack(locs []uint64, stk []uint64) []uint64 {
+	var deck pcDeck
+	flush := func() {
+		if len(deck.frames) == 0 {
+			return
+		}
+		id := b.locForFrames(deck.pcs[0], deck.frames)
+		for _, pc := range deck.pcs {
+			b.locs[pc] = int(id)
+		}
+		if id != 0 {
+			locs = append(locs, id)
+		}
+		deck.reset()
+	}
+
+	for _, addr := range stk {
+		if id := uint64(b.locs[addr]); id != 0 {
+			flush()
+			locs = append(locs, id)
+			continue
+		}
+
+		frames := b.locMap[addr]
+		if isGoexit(frames) {
+			// runtime.goexit is the synthetic bottom-of-stack frame
+			// every goroutine's stack ends in; pprof has no use for
+			// it, so it's dropped rather than given a Location.
+			flush()
+			continue
+		}
+		if len(frames) == 0 {
+			// No symbolization data for addr; still record a
+			// (lineless) Location for it, same as before frame
+			// expansion was added.
+			flush()
+			id := b.locForFrames(addr, nil)
+			b.locs[addr] = int(id)
+			if id != 0 {
+				locs = append(locs, id)
+			}
+			continue
+		}
+
+		if !deck.tryAdd(addr, frames) {
+			flush()
+			deck.tryAdd(addr, frames)
+		}
+	}
+	flush()
+	return locs
+}
+
+// newProfileBuilderNoMapping allocates a ProfileBuilder with its
+// encoding state initialized but no address mappings read yet. It's
+// split out from newProfileBuilder for callers like Merger, which
+// build a profile out of already-decoded inputs rather than out of
+// live samples taken in this process, so reading this process's own
+// /proc/self/maps would be meaningless.
+func newProfileBuilderNoMapping(w io.Writer, locMap LocMap) *ProfileBuilder {
 	zw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
-	b := &ProfileBuilder{
+	return &ProfileBuilder{
 		w:         w,
 		zw:        zw,
 		start:     time.Now(),
@@ -265,10 +403,26 @@ func NewProfileBuilder(w io.Writer, locMap LocMap) *ProfileBuilder {
 		locs:      map[uint64]int{},
 		funcs:     map[string]int{},
 	}
+}
+
+// newProfileBuilder allocates a ProfileBuilder with its encoding state
+// initialized and its address mappings read, shared by every profile
+// kind's public constructor that samples this process live (CPU,
+// heap, delta).
+func newProfileBuilder(w io.Writer, locMap LocMap) *ProfileBuilder {
+	b := newProfileBuilderNoMapping(w, locMap)
 	b.readMapping()
 	return b
 }
 
+// NewProfileBuilder returns a new ProfileBuilder.
+// CPU profiling data obtained from the runtime can be added
+// by calling b.addCPUData, and then the eventual profile
+// can be obtained by calling b.finish.
+func NewProfileBuilder(w io.Writer, locMap LocMap) *ProfileBuilder {
+	return newProfileBuilder(w, locMap)
+}
+
 // build completes and returns the constructed profile.
 func (b *ProfileBuilder) build() {
 	b.end = time.Now()
@@ -317,6 +471,14 @@ func (b *ProfileBuilder) build() {
 	//	b.pbSample(values, locs, labels)
 	//}
 
+	b.finish()
+}
+
+// finish writes out the mappings and string table that trail every
+// profile kind and flushes the gzip writer. It's the common tail of
+// build() (CPU) and WriteHeapProto (heap), factored out so neither
+// has to remember the other's bookkeeping.
+func (b *ProfileBuilder) finish() {
 	for i, m := range b.mem {
 		hasFunctions := m.funcs == lookupTried // lookupTried but not lookupFailed
 		b.pbMapping(tagProfile_Mapping, uint64(i+1), uint64(m.start), uint64(m.end), m.offset, m.file, m.buildID, hasFunctions)
@@ -330,16 +492,6 @@ func (b *ProfileBuilder) build() {
 	b.zw.Close()
 }
 
-// readMapping reads /proc/self/maps and writes mappings to b.pb.
-// It saves the address ranges of the mappings in b.mem for use
-// when emitting locations.
-func (b *ProfileBuilder) readMapping() {
-	b.addMappingEntry(0, 0, 0, "", "", true)
-	// TODO(hyangah): make addMapping return *memMap or
-	// take a memMap struct, and get rid of addMappingEntry
-	// that takes a bunch of positional arguments.
-}
-
 func (b *ProfileBuilder) addMapping(lo, hi, offset uint64, file, buildID string) {
 	b.addMappingEntry(lo, hi, offset, file, buildID, false)
 }
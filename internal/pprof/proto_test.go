@@ -0,0 +1,160 @@
+package pprof
+
+import (
+	"io"
+	"testing"
+)
+
+// TestPcDeckTryAddInlineTower verifies the normal case tryAdd exists
+// for: a PC whose innermost frame continues the tower already on the
+// deck (same Function, File, and Entry as the deck's last frame) is
+// merged in, with the duplicated boundary frame dropped.
+func TestPcDeckTryAddInlineTower(t *testing.T) {
+	var d pcDeck
+	d.tryAdd(0x100, []Frame{
+		{Function: "pkg.Inlined", File: "f.go", Line: 3, Entry: 0x100},
+		{Function: "pkg.Caller", File: "f.go", Line: 20, Entry: 0x90},
+	})
+	if ok := d.tryAdd(0x101, []Frame{
+		{Function: "pkg.Caller", File: "f.go", Line: 20, Entry: 0x90},
+	}); !ok {
+		t.Fatal("tryAdd: want true for a PC continuing the same inline tower")
+	}
+	if len(d.pcs) != 2 || len(d.frames) != 2 {
+		t.Fatalf("deck after merge: got %d pcs, %d frames, want 2, 2", len(d.pcs), len(d.frames))
+	}
+	if d.frames[0].Function != "pkg.Inlined" || d.frames[1].Function != "pkg.Caller" {
+		t.Errorf("deck frames: got %+v, want [Inlined Caller]", d.frames)
+	}
+}
+
+// TestPcDeckTryAddRejectsUnrelatedFrame verifies tryAdd refuses to
+// merge a PC whose frame shares nothing with the deck's boundary
+// frame.
+func TestPcDeckTryAddRejectsUnrelatedFrame(t *testing.T) {
+	var d pcDeck
+	d.tryAdd(0x200, []Frame{{Function: "pkg.A", File: "a.go", Line: 1, Entry: 0x200}})
+	if ok := d.tryAdd(0x201, []Frame{{Function: "pkg.B", File: "b.go", Line: 2, Entry: 0x201}}); ok {
+		t.Fatal("tryAdd: want false for a PC unrelated to the deck's boundary frame")
+	}
+}
+
+// TestPcDeckTryAddRejectsRecursion verifies that two genuinely
+// separate, non-inlined frames of a recursive call aren't merged even
+// though they share the same Entry and File: tryAdd also requires the
+// Function name to match the deck's boundary frame name before
+// merging, and here they don't — the frames are two distinct lines of
+// the call site inside a recursive function, not one inline tower.
+func TestPcDeckTryAddRejectsRecursion(t *testing.T) {
+	var d pcDeck
+	d.tryAdd(0x300, []Frame{{Function: "pkg.Recurse", File: "r.go", Line: 15, Entry: 0x300}})
+	if ok := d.tryAdd(0x310, []Frame{{Function: "pkg.RecurseCaller", File: "r.go", Line: 16, Entry: 0x300}}); ok {
+		t.Fatal("tryAdd: want false for a recursive call's distinct frame, not an inline tower")
+	}
+}
+
+// buildAndDecodeLocs runs stk through a fresh ProfileBuilder's
+// appendLocsForStack and decodes the Location/Function messages it
+// wrote, letting tests assert on pcDeck's merge decisions without a
+// full encode/decode round trip through gzip.
+func buildAndDecodeLocs(t *testing.T, locMap LocMap, stk []uint64) (locs []uint64, framesByID map[uint64][]Frame) {
+	t.Helper()
+	b := newProfileBuilderNoMapping(io.Discard, locMap)
+	b.addMappingEntry(0, 0, 0, "", "", true)
+
+	locs = b.appendLocsForStack(nil, stk)
+
+	funcs := map[uint64]decodedFunction{}
+	var locBufs [][]byte
+	err := decodeFields(b.pb.data, func(f protoField) error {
+		switch f.tag {
+		case tagProfile_Function:
+			id, fn, err := decodeFunction(f.buf, b.strings)
+			if err != nil {
+				return err
+			}
+			funcs[id] = fn
+		case tagProfile_Location:
+			locBufs = append(locBufs, f.buf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decodeFields: %v", err)
+	}
+
+	framesByID = map[uint64][]Frame{}
+	for _, buf := range locBufs {
+		id, frames, err := decodeLocation(buf, funcs)
+		if err != nil {
+			t.Fatalf("decodeLocation: %v", err)
+		}
+		framesByID[id] = frames
+	}
+	return locs, framesByID
+}
+
+// TestAppendLocsForStackMergesInlineTower verifies a two-PC inline
+// tower split across addresses 0x100 and 0x101 (the case
+// TestPcDeckTryAddInlineTower exercises directly) collapses into a
+// single Location carrying both Lines, innermost first.
+func TestAppendLocsForStackMergesInlineTower(t *testing.T) {
+	locMap := LocMap{
+		0x100: {
+			{Function: "pkg.Inlined", File: "f.go", Line: 3, Entry: 0x100},
+			{Function: "pkg.Caller", File: "f.go", Line: 20, Entry: 0x90},
+		},
+		0x101: {
+			{Function: "pkg.Caller", File: "f.go", Line: 20, Entry: 0x90},
+		},
+	}
+	locs, framesByID := buildAndDecodeLocs(t, locMap, []uint64{0x100, 0x101})
+	if len(locs) != 1 {
+		t.Fatalf("locs: got %d, want 1 (merged tower)", len(locs))
+	}
+	frames := framesByID[locs[0]]
+	if len(frames) != 2 || frames[0].Function != "pkg.Inlined" || frames[1].Function != "pkg.Caller" {
+		t.Errorf("merged location frames: got %+v, want [Inlined Caller]", frames)
+	}
+}
+
+// TestAppendLocsForStackKeepsRecursionSeparate verifies recursive
+// calls of the same function produce one Location per frame rather
+// than being folded into the inline tower they superficially resemble
+// (same Entry and File, but a different call-site Function).
+func TestAppendLocsForStackKeepsRecursionSeparate(t *testing.T) {
+	locMap := LocMap{
+		0x300: {{Function: "pkg.Recurse", File: "r.go", Line: 15, Entry: 0x300}},
+		0x310: {{Function: "pkg.RecurseCaller", File: "r.go", Line: 16, Entry: 0x300}},
+	}
+	locs, framesByID := buildAndDecodeLocs(t, locMap, []uint64{0x300, 0x310})
+	if len(locs) != 2 {
+		t.Fatalf("locs: got %d, want 2 (recursion must not collapse)", len(locs))
+	}
+	if got := framesByID[locs[0]]; len(got) != 1 || got[0].Function != "pkg.Recurse" {
+		t.Errorf("locs[0] frames: got %+v, want [Recurse]", got)
+	}
+	if got := framesByID[locs[1]]; len(got) != 1 || got[0].Function != "pkg.RecurseCaller" {
+		t.Errorf("locs[1] frames: got %+v, want [RecurseCaller]", got)
+	}
+}
+
+// TestAppendLocsForStackUnrelatedAdjacentFrames verifies two PCs with
+// nothing in common (different Entry, File, and Function) each get
+// their own Location.
+func TestAppendLocsForStackUnrelatedAdjacentFrames(t *testing.T) {
+	locMap := LocMap{
+		0x200: {{Function: "pkg.A", File: "a.go", Line: 1, Entry: 0x200}},
+		0x201: {{Function: "pkg.B", File: "b.go", Line: 2, Entry: 0x201}},
+	}
+	locs, framesByID := buildAndDecodeLocs(t, locMap, []uint64{0x200, 0x201})
+	if len(locs) != 2 {
+		t.Fatalf("locs: got %d, want 2", len(locs))
+	}
+	if got := framesByID[locs[0]]; len(got) != 1 || got[0].Function != "pkg.A" {
+		t.Errorf("locs[0] frames: got %+v, want [A]", got)
+	}
+	if got := framesByID[locs[1]]; len(got) != 1 || got[0].Function != "pkg.B" {
+		t.Errorf("locs[1] frames: got %+v, want [B]", got)
+	}
+}
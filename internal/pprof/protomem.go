@@ -0,0 +1,79 @@
+package pprof
+
+import (
+	"io"
+	"math"
+	"runtime"
+	"time"
+)
+
+// NewMemProfileBuilder returns a ProfileBuilder for encoding a heap
+// profile at the given sampling rate (runtime.MemProfileRate). Feed it
+// to WriteHeapProto once the caller has collected records via
+// runtime.MemProfile.
+func NewMemProfileBuilder(w io.Writer, locMap LocMap, rate int64) *ProfileBuilder {
+	b := newProfileBuilder(w, locMap)
+	b.period = rate
+	return b
+}
+
+// WriteHeapProto encodes records as a pprof heap profile and closes
+// it. Sample types are emitted in the canonical order pprof expects:
+// alloc_objects/count, alloc_space/bytes, inuse_objects/count,
+// inuse_space/bytes. This is the analogue of upstream
+// runtime/pprof/protomem.go.
+func (b *ProfileBuilder) WriteHeapProto(records []runtime.MemProfileRecord) {
+	b.end = time.Now()
+
+	b.pb.int64Opt(tagProfile_TimeNanos, b.start.UnixNano())
+	b.pbValueType(tagProfile_SampleType, "alloc_objects", "count")
+	b.pbValueType(tagProfile_SampleType, "alloc_space", "bytes")
+	b.pbValueType(tagProfile_SampleType, "inuse_objects", "count")
+	b.pbValueType(tagProfile_SampleType, "inuse_space", "bytes")
+	b.pbValueType(tagProfile_PeriodType, "space", "bytes")
+	b.pb.int64Opt(tagProfile_Period, b.period)
+
+	var locs []uint64
+	var stk []uint64
+	for _, r := range records {
+		allocObjects, allocBytes := unsampleHeapSample(r.AllocObjects, r.AllocBytes, b.period)
+		inuseObjects, inuseBytes := unsampleHeapSample(r.InUseObjects(), r.InUseBytes(), b.period)
+
+		var avgSize int64
+		if r.AllocObjects > 0 {
+			avgSize = r.AllocBytes / r.AllocObjects
+		}
+
+		stk = stk[:0]
+		for _, pc := range r.Stack() {
+			stk = append(stk, uint64(pc))
+		}
+		locs = b.appendLocsForStack(locs[:0], stk)
+
+		values := []int64{allocObjects, allocBytes, inuseObjects, inuseBytes}
+		labels := func() {
+			b.pbLabel(tagSample_Label, "bytes", "", avgSize)
+		}
+		b.pbSample(values, locs, labels)
+	}
+
+	b.finish()
+}
+
+// unsampleHeapSample scales count and size up to recover an unbiased
+// estimate of the true allocation counts for a sample recorded at
+// every rate-th byte allocated, following the same formula as
+// runtime/pprof's scaleHeapSample: 1 / (1 - exp(-avgSize/rate)). It's
+// called separately for the alloc and inuse pairs of a record, since
+// their average object sizes (and so their scale factors) can diverge.
+// It returns count and size unchanged when there's nothing to scale
+// from, matching the convention that unsampled profiles (rate<=1) are
+// already exact.
+func unsampleHeapSample(count, size, rate int64) (int64, int64) {
+	if count == 0 || size == 0 || rate <= 1 {
+		return count, size
+	}
+	avgSize := float64(size) / float64(count)
+	scale := 1 / (1 - math.Exp(-avgSize/float64(rate)))
+	return int64(float64(count) * scale), int64(float64(size) * scale)
+}
@@ -0,0 +1,63 @@
+package pprof
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUnsampleHeapSampleNoScaling(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		count, size, rate int64
+	}{
+		{"zero count", 0, 1024, 512},
+		{"zero size", 5, 0, 512},
+		{"unsampled, rate 1", 5, 1024, 1},
+		{"unsampled, rate 0", 5, 1024, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotCount, gotSize := unsampleHeapSample(tc.count, tc.size, tc.rate)
+			if gotCount != tc.count || gotSize != tc.size {
+				t.Errorf("unsampleHeapSample(%d, %d, %d) = (%d, %d), want (%d, %d)",
+					tc.count, tc.size, tc.rate, gotCount, gotSize, tc.count, tc.size)
+			}
+		})
+	}
+}
+
+func TestUnsampleHeapSampleScales(t *testing.T) {
+	const rate = 512 * 1024
+	count, size := int64(10), int64(10*4096) // avgSize 4096, well above rate's noise floor
+
+	gotCount, gotSize := unsampleHeapSample(count, size, rate)
+	if gotCount <= count || gotSize <= size {
+		t.Fatalf("unsampleHeapSample(%d, %d, %d) = (%d, %d), want both scaled up",
+			count, size, rate, gotCount, gotSize)
+	}
+
+	wantScale := 1 / (1 - math.Exp(-float64(size)/float64(count)/float64(rate)))
+	wantCount := int64(float64(count) * wantScale)
+	wantSize := int64(float64(size) * wantScale)
+	if gotCount != wantCount || gotSize != wantSize {
+		t.Errorf("unsampleHeapSample(%d, %d, %d) = (%d, %d), want (%d, %d)",
+			count, size, rate, gotCount, gotSize, wantCount, wantSize)
+	}
+}
+
+// TestUnsampleHeapSampleIndependentScale verifies that alloc and inuse
+// pairs with different average object sizes get different scale
+// factors, i.e. callers must invoke unsampleHeapSample separately for
+// each pair rather than reusing one pair's scale for the other.
+func TestUnsampleHeapSampleIndependentScale(t *testing.T) {
+	const rate = 512 * 1024
+
+	allocCount, allocSize := unsampleHeapSample(100, 100*1024, rate)    // avgSize 1024
+	inuseCount, inuseSize := unsampleHeapSample(100, 100*64*1024, rate) // avgSize 64x bigger
+
+	allocScale := float64(allocSize) / (100 * 1024)
+	inuseScale := float64(inuseSize) / (100 * 64 * 1024)
+	if math.Abs(allocScale-inuseScale) < 1e-6 {
+		t.Fatalf("expected distinct scale factors for differing average sizes, got alloc=%v inuse=%v (counts %d, %d)",
+			allocScale, inuseScale, allocCount, inuseCount)
+	}
+}
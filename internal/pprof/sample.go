@@ -0,0 +1,79 @@
+package pprof
+
+import (
+	"context"
+	"runtime/pprof"
+	"sort"
+)
+
+// AddSample adds one already-collected stack sample straight to the
+// profile being built, encoding it immediately instead of first
+// accumulating it in memory. stack is leaf-first and raw/signal-style,
+// i.e. every frame above the leaf is already a return PC but the leaf
+// itself points at the instruction that was executing when the sample
+// was taken (this is what a signal-based CPU sampler hands you, unlike
+// runtime.Callers, which returns return PCs for every frame including
+// the leaf). Its leaf address is bumped by one so it looks like a
+// return PC too, matching what locForPC expects for every other frame.
+//
+// labels attaches string-valued pprof labels and numLabels
+// numeric-valued ones (e.g. the "bytes" label WriteHeapProto uses);
+// either may be nil. Both are string-table-deduplicated the same way
+// every other string this package writes is, via stringIndex.
+func (b *ProfileBuilder) AddSample(stack []uint64, values []int64, labels map[string][]string, numLabels map[string]int64) {
+	if len(stack) > 0 {
+		bumped := make([]uint64, len(stack))
+		copy(bumped, stack)
+		bumped[0]++
+		stack = bumped
+	}
+
+	var locs []uint64
+	locs = b.appendLocsForStack(locs, stack)
+
+	b.pbSample(values, locs, func() {
+		for _, k := range sortedStringKeys(labels) {
+			for _, v := range labels[k] {
+				b.pbLabel(tagSample_Label, k, v, 0)
+			}
+		}
+		for _, k := range sortedInt64Keys(numLabels) {
+			b.pbLabel(tagSample_Label, k, "", numLabels[k])
+		}
+	})
+}
+
+// AddSampleWithContext is AddSample, but reads string labels from ctx
+// the same way runtime/pprof's own CPU profiler does: whatever was
+// attached via pprof.WithLabels. This lets collectors tag samples with
+// request/tenant/trace-id labels without threading them through every
+// call site by hand.
+func (b *ProfileBuilder) AddSampleWithContext(ctx context.Context, stack []uint64, values []int64, numLabels map[string]int64) {
+	var labels map[string][]string
+	pprof.ForLabels(ctx, func(key, value string) bool {
+		if labels == nil {
+			labels = map[string][]string{}
+		}
+		labels[key] = append(labels[key], value)
+		return true
+	})
+	b.AddSample(stack, values, labels, numLabels)
+}
+
+func sortedStringKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedInt64Keys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
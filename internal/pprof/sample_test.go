@@ -0,0 +1,98 @@
+package pprof
+
+import (
+	"context"
+	"io"
+	"runtime/pprof"
+	"testing"
+)
+
+// newTestProfileBuilder returns a ProfileBuilder with a single fake
+// mapping entry, so AddSample's locForFrames has somewhere to attach a
+// symbolized address without needing a real /proc/self/maps.
+func newTestProfileBuilder(locMap LocMap) *ProfileBuilder {
+	b := newProfileBuilderNoMapping(io.Discard, locMap)
+	b.addMappingEntry(0, 0, 0, "", "", true)
+	return b
+}
+
+// decodeSamples decodes every top-level Sample message in b.pb.data.
+func decodeSamples(t *testing.T, b *ProfileBuilder) []decodedSample {
+	t.Helper()
+	var out []decodedSample
+	err := decodeFields(b.pb.data, func(f protoField) error {
+		if f.tag != tagProfile_Sample {
+			return nil
+		}
+		s, err := decodeSample(f.buf, b.strings)
+		if err != nil {
+			return err
+		}
+		out = append(out, s)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decodeFields: %v", err)
+	}
+	return out
+}
+
+func TestAddSampleBumpsLeafToLookLikeAReturnPC(t *testing.T) {
+	// AddSample's stack is raw/signal-style, so the leaf PC (0x10) is
+	// where execution actually was, but locForPC/LocMap are keyed by
+	// return PCs; AddSample must bump it before looking it up.
+	locMap := LocMap{0x11: {{Function: "pkg.Leaf", File: "f.go", Line: 1, Entry: 0x11}}}
+	b := newTestProfileBuilder(locMap)
+
+	b.AddSample([]uint64{0x10}, []int64{1}, nil, nil)
+
+	samples := decodeSamples(t, b)
+	if len(samples) != 1 || len(samples[0].locationIDs) != 1 {
+		t.Fatalf("samples: got %+v, want one sample with one location", samples)
+	}
+	if got, want := samples[0].locationIDs[0], uint64(b.locs[0x11]); want == 0 || got != want {
+		t.Errorf("location: got ID %d, want the one recorded for bumped PC 0x11 (%d)", got, want)
+	}
+}
+
+func TestAddSampleEncodesStringAndNumericLabels(t *testing.T) {
+	locMap := LocMap{1: {{Function: "pkg.F", File: "f.go", Line: 1, Entry: 1}}}
+	b := newTestProfileBuilder(locMap)
+
+	b.AddSample([]uint64{0}, []int64{42}, map[string][]string{"tenant": {"acme"}}, map[string]int64{"bytes": 4096})
+
+	samples := decodeSamples(t, b)
+	if len(samples) != 1 {
+		t.Fatalf("samples: got %d, want 1", len(samples))
+	}
+	s := samples[0]
+	if got, want := s.values, []int64{42}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("values: got %v, want %v", got, want)
+	}
+	if got := s.labels["tenant"]; len(got) != 1 || got[0] != "acme" {
+		t.Errorf("labels[tenant]: got %v, want [acme]", got)
+	}
+	if got, ok := s.numLabels["bytes"]; !ok || got != 4096 {
+		t.Errorf("numLabels[bytes]: got %d, %v, want 4096, true", got, ok)
+	}
+}
+
+func TestAddSampleWithContextReadsPprofLabels(t *testing.T) {
+	locMap := LocMap{1: {{Function: "pkg.F", File: "f.go", Line: 1, Entry: 1}}}
+	b := newTestProfileBuilder(locMap)
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("route", "/v1/profiles"))
+	b.AddSampleWithContext(ctx, []uint64{0}, []int64{1}, map[string]int64{"bytes": 128})
+
+	samples := decodeSamples(t, b)
+	if len(samples) != 1 {
+		t.Fatalf("samples: got %d, want 1", len(samples))
+	}
+	s := samples[0]
+	if got := s.labels["route"]; len(got) != 1 || got[0] != "/v1/profiles" {
+		t.Errorf("labels[route]: got %v, want [/v1/profiles]", got)
+	}
+	if got, ok := s.numLabels["bytes"]; !ok || got != 128 {
+		t.Errorf("numLabels[bytes]: got %d, %v, want 128, true", got, ok)
+	}
+}